@@ -0,0 +1,61 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// WriteImageBase64 writes a PNG-encoded image representation of the
+// captcha with the given id as a "data:image/png;base64,..." URI, so it
+// can be embedded directly in HTML or JSON without a second round-trip to
+// fetch the image. The image will have the given width and height.
+func WriteImageBase64(id string, width, height int) (string, error) {
+	var buf bytes.Buffer
+	if err := WriteImage(&buf, id, width, height); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// NewBase64 is like New, but also returns the data URI of the generated
+// captcha's image so that JSON backends can hand both to the client in a
+// single response, without requiring the client to fetch the image via
+// Server's http.Handler.
+func NewBase64(width, height int) (id, dataURI string, err error) {
+	id = New()
+	dataURI, err = WriteImageBase64(id, width, height)
+	return id, dataURI, err
+}
+
+// verifyRequest is the JSON body VerifyJSON expects.
+type verifyRequest struct {
+	Id     string `json:"id"`
+	Answer string `json:"answer"`
+}
+
+// verifyResponse is the JSON body VerifyJSON writes.
+type verifyResponse struct {
+	Success bool `json:"success"`
+}
+
+// VerifyJSON reads a JSON body of the form {"id": ..., "answer": ...} from
+// r, verifies the answer against the given captcha id, and writes
+// {"success": true|false} as the JSON response. It is meant for JSON APIs
+// that otherwise have no use for Server's http.Handler.
+func VerifyJSON(w http.ResponseWriter, r *http.Request) error {
+	var req verifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	success := VerifyString(req.Id, req.Answer)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(verifyResponse{Success: success})
+}
@@ -5,19 +5,23 @@
 // Package captcha implements generation and verification of image and audio
 // CAPTCHAs.
 //
-// A captcha solution is the sequence of digits 0-9 with the defined length.
-// There are two captcha representations: image and audio.
+// New and NewLen always create a digits-and-letters challenge rendered as a
+// PNG image, with the solution printed on it in such a way that makes it
+// hard for computers to solve it using OCR. NewWithDriver instead fixes the
+// representation at creation time, by the Driver passed to it: DriverDigit,
+// DriverString, DriverMath, and DriverChinese render as a PNG the same way,
+// while DriverAudio renders as a WAVE-encoded (8 kHz unsigned 8-bit) sound
+// instead. Unlike the original image/audio pair, which let either
+// representation be requested for the same id, a given id now only ever
+// renders the one way its Driver (or New/NewLen's implicit image) produced
+// it; requesting the other extension is the same as requesting an id that
+// doesn't exist.
 //
-// An image representation is a PNG-encoded image with the solution printed on
-// it in such a way that makes it hard for computers to solve it using OCR.
+// To make it hard for computers to solve an audio captcha, its tones have
+// random speed and pitch, and there is a randomly generated background noise
+// mixed into the sound.
 //
-// An audio representation is a WAVE-encoded (8 kHz unsigned 8-bit) sound with
-// the spoken solution (currently in English, Russian, Chinese, and Japanese).
-// To make it hard for computers to solve audio captcha, the voice that
-// pronounces numbers has random speed and pitch, and there is a randomly
-// generated background noise mixed into the sound.
-//
-// This package doesn't require external files or libraries to generate captcha
+// This package doesn't require external files to generate captcha
 // representations; it is self-contained.
 //
 // To make captchas one-time, the package includes a memory storage that stores
@@ -47,8 +51,8 @@ package captcha
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"errors"
-	"fmt"
 	"io"
 	"time"
 )
@@ -71,6 +75,10 @@ var (
 
 // SetCustomStore sets custom storage for captchas, replacing the default
 // memory store. This function must be called before generating any captchas.
+//
+// The default memoryStore only works within a single process; deployments
+// that run more than one instance of the app should pass a shared store
+// instead, such as the one returned by NewRedisStore.
 func SetCustomStore(s Store) {
 	globalStore = s
 }
@@ -84,61 +92,211 @@ func New() string {
 // NewLen is just like New, but accepts length of a captcha solution as the
 // argument.
 func NewLen(length int) (id string) {
-	id = randomId()
 	// Store the indices (0-35) not the characters
 	digits := randomBytesMod(length, 36)
+
+	// Stores such as the one returned by NewStatelessStore derive the id
+	// from the content itself, rather than letting it be chosen upfront.
+	if s, ok := globalStore.(IdentifyingStore); ok {
+		return s.SetReturningID(digits)
+	}
+
+	id = randomId()
 	globalStore.Set(id, digits)
 	return
 }
 
 // Reload generates and remembers new digits for the given captcha id.  This
-// function returns false if there is no captcha with the given id.
+// function returns false if there is no captcha with the given id, or if
+// globalStore has no way to change what id is stored under (as with the
+// store returned by NewStatelessStore, whose id is the token the content
+// is sealed into).
 //
 // After calling this function, the image or audio presented to a user must be
 // refreshed to show the new captcha representation (WriteImage and WriteAudio
 // will write the new one).
+//
+// For a captcha created with NewWithDriver, Reload regenerates through the
+// same Driver (found via its registered tag), so the new content is still
+// shaped the way that Driver's WriteTo expects. The regenerated challenge
+// uses the configuration of the Driver value held in the registry, since
+// only the content and answer Generate returned, not the original Driver
+// value, are persisted: for a built-in driver that is its zero value (e.g.
+// DefaultLen instead of a custom Length), and for a custom driver it is
+// the value first passed to NewWithDriver or RegisterDriver.
 func Reload(id string) bool {
+	// IdentifyingStore implementations choose their own id from content
+	// (see SetReturningID), which means an existing id can't be made to
+	// point at different content the way Set does for a plain Store:
+	// reload would have to mint a new id the caller was never told
+	// about. Report that up front instead of pretending it worked.
+	if _, ok := globalStore.(IdentifyingStore); ok {
+		return false
+	}
+
 	old := globalStore.Get(id, false)
 	if old == nil {
 		return false
 	}
+
+	if driver, _, _, ok := untagContent(old); ok {
+		tag, ok := driverTag(driver)
+		if !ok {
+			return false
+		}
+		content, answer := driver.Generate()
+		globalStore.Set(id, taggedContent(tag, answer, content))
+		return true
+	}
+
 	globalStore.Set(id, RandomDigits(len(old)))
 	return true
 }
 
+// renderCaptcha writes the representation of the captcha with the given id
+// to w, using ext to pick which representation: ".png" for the
+// digits-and-letters image New and NewLen produce, or whatever extension
+// the Driver behind a NewWithDriver id declares via its Ext method.
+// Requesting an extension other than the one the id was actually created
+// for returns ErrNotFound, the same as requesting an id that doesn't exist.
+func renderCaptcha(w io.Writer, id, ext string, width, height int) error {
+	stored := globalStore.Get(id, false)
+	if stored == nil {
+		return ErrNotFound
+	}
+
+	if driver, _, content, ok := untagContent(stored); ok {
+		if ext != driver.Ext() {
+			return ErrNotFound
+		}
+		return driver.WriteTo(w, content, width, height)
+	}
+
+	// Legacy content from New or NewLen is always a digits-and-letters
+	// image, as it was before Driver existed.
+	if ext != ".png" {
+		return ErrNotFound
+	}
+	_, err := NewImage(id, stored, width, height).WriteTo(w)
+	return err
+}
+
 // WriteImage writes PNG-encoded image representation of the captcha with the
 // given id. The image will have the given width and height.
 func WriteImage(w io.Writer, id string, width, height int) error {
-	d := globalStore.Get(id, false)
-	if d == nil {
-		return ErrNotFound
+	return renderCaptcha(w, id, ".png", width, height)
+}
+
+// verifyConfig holds the options set by VerifyOption functions passed to
+// Verify and VerifyString.
+type verifyConfig struct {
+	caseSensitive bool
+	keepOnFailure bool
+}
+
+// VerifyOption configures the behavior of Verify and VerifyString.
+type VerifyOption func(*verifyConfig)
+
+// WithCaseSensitive controls whether letters in the submitted answer must
+// match the case they were rendered in (captchas are rendered in upper
+// case). It is false by default, so "a1b2" and "A1B2" are both accepted.
+func WithCaseSensitive(caseSensitive bool) VerifyOption {
+	return func(c *verifyConfig) { c.caseSensitive = caseSensitive }
+}
+
+// WithKeepOnFailure controls whether a wrong answer consumes the captcha.
+// It is false by default, matching the historical one-shot behavior: any
+// call to Verify or VerifyString, right or wrong, invalidates the id. The
+// exceptions are an empty answer and, for a New or NewLen id, an answer
+// VerifyString rejects for a character it can't map (including a
+// lowercase letter under WithCaseSensitive(true)): these return false
+// without touching the store. Pass WithKeepOnFailure(true) to let a user
+// retry a hard-to-read captcha instead of being forced to reload a new one
+// after a typo.
+func WithKeepOnFailure(keepOnFailure bool) VerifyOption {
+	return func(c *verifyConfig) { c.keepOnFailure = keepOnFailure }
+}
+
+// storedAnswer returns the bytes digits must match for stored to count as
+// solved. For legacy content from New or NewLen, that's stored itself (the
+// 0-35 digit indices). For a NewWithDriver id, comparing against the raw
+// tagged bytes would never succeed — and would leak content past the
+// answer it's tagged with — so it's the embedded answer instead.
+func storedAnswer(stored []byte) []byte {
+	if _, answer, _, ok := untagContent(stored); ok {
+		return []byte(answer)
 	}
-	_, err := NewImage(id, d, width, height).WriteTo(w)
-	return err
+	return stored
+}
+
+// answerMatches reports, in constant time, whether digits solves stored.
+// Unless cfg.caseSensitive is set, letters are compared without regard to
+// case; the 0-35 indices of legacy content contain no letters to fold.
+func answerMatches(digits, stored []byte, cfg verifyConfig) bool {
+	want := storedAnswer(stored)
+	if !cfg.caseSensitive {
+		digits, want = bytes.ToUpper(digits), bytes.ToUpper(want)
+	}
+	return subtle.ConstantTimeCompare(digits, want) == 1
 }
 
 // Verify returns true if the given digits are the ones that were used to
-// create the given captcha id.
+// create the given captcha id. For a captcha created with NewWithDriver,
+// digits must be the answer bytes NewWithDriver returned (VerifyString
+// does this conversion for you), not the 0-35 digit indices New and NewLen
+// use.
 //
-// The function deletes the captcha with the given id from the internal
-// storage, so that the same captcha can't be verified anymore.
+// By default the function deletes the captcha with the given id from the
+// internal storage, whether or not digits was correct, so that the same
+// captcha can't be verified anymore. Pass WithKeepOnFailure(true) to keep
+// a wrong answer's captcha alive for a retry. An empty digits returns
+// false without touching the store.
+func Verify(id string, digits []byte, opts ...VerifyOption) bool {
+	if len(digits) == 0 {
+		return false
+	}
+
+	var cfg verifyConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if !cfg.keepOnFailure {
+		stored := globalStore.Get(id, true)
+		if stored == nil {
+			return false
+		}
+		return answerMatches(digits, stored, cfg)
+	}
 
-func Verify(id string, digits []byte) bool {
-	if digits == nil || len(digits) == 0 {
+	stored := globalStore.Get(id, false)
+	if stored == nil {
 		return false
 	}
-	reald := globalStore.Get(id, true)
-	if reald == nil {
+	if !answerMatches(digits, stored, cfg) {
 		return false
 	}
+	// Only consume the captcha once it has actually been solved.
+	globalStore.Get(id, true)
+	return true
+}
 
-	// Temporary debug logging
-	fmt.Printf("Stored: %v\nInput: %v\n", reald, digits)
+func VerifyString(id string, answer string, opts ...VerifyOption) bool {
+	// A NewWithDriver id's answer isn't necessarily a 0-35 digit index
+	// string (DriverChinese's answer is Han characters, DriverMath's can
+	// be a multi-digit number), so it's compared as the literal bytes of
+	// answer instead of being re-encoded below.
+	if stored := globalStore.Get(id, false); stored != nil {
+		if _, _, _, ok := untagContent(stored); ok {
+			return Verify(id, []byte(answer), opts...)
+		}
+	}
 
-	return bytes.Equal(digits, reald)
-}
+	var cfg verifyConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 
-func VerifyString(id string, answer string) bool {
 	// Convert answer to indices (0-35)
 	ns := make([]byte, 0, len(answer))
 	for _, c := range answer {
@@ -148,10 +306,13 @@ func VerifyString(id string, answer string) bool {
 		case 'A' <= c && c <= 'Z':
 			ns = append(ns, byte(c-'A'+10)) // A=10, B=11, etc.
 		case 'a' <= c && c <= 'z':
+			if cfg.caseSensitive {
+				return false
+			}
 			ns = append(ns, byte(c-'a'+10)) // lowercase
 		default:
 			return false
 		}
 	}
-	return Verify(id, ns)
+	return Verify(id, ns, opts...)
 }
@@ -0,0 +1,365 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Driver generates a captcha challenge and renders its representation.
+// Built-in drivers cover the digit, string, math, Chinese, and audio
+// challenge types; NewWithDriver lets a caller pick one per request instead
+// of being locked into the digits-and-letters challenge New and NewLen
+// produce.
+//
+// Generate must return content that is entirely self-contained: WriteTo
+// renders from content alone, without access to the Driver value that
+// created it, so the same challenge can be replayed later by a different
+// Driver instance (or a different process, when content travels through a
+// shared Store such as the one added by NewRedisStore).
+type Driver interface {
+	// Generate creates a new challenge, returning the content to store and
+	// the answer the user is expected to submit.
+	Generate() (content []byte, answer string)
+
+	// WriteTo renders content, as produced by Generate, to w using the
+	// given dimensions. Audio drivers ignore width and height.
+	WriteTo(w io.Writer, content []byte, width, height int) error
+
+	// Ext returns the file extension this driver's representation is
+	// served under, e.g. ".png" or ".wav".
+	Ext() string
+}
+
+// DefaultAlphabet is the alphabet DriverString uses when none is given.
+const DefaultAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghjkmnpqrstuvwxyz"
+
+// DriverDigit reproduces the challenge New and NewLen have always created:
+// a run of random digits and letters rendered as a distorted PNG.
+type DriverDigit struct {
+	// Length is the number of characters in the challenge. DefaultLen is
+	// used if Length is zero.
+	Length int
+}
+
+func (d DriverDigit) Generate() (content []byte, answer string) {
+	length := d.Length
+	if length == 0 {
+		length = DefaultLen
+	}
+	digits := randomBytesMod(length, 36)
+	return digits, digitsToString(digits)
+}
+
+func (d DriverDigit) WriteTo(w io.Writer, content []byte, width, height int) error {
+	_, err := NewImage("", content, width, height).WriteTo(w)
+	return err
+}
+
+func (d DriverDigit) Ext() string { return ".png" }
+
+// DriverString is like DriverDigit, but draws its characters from a
+// caller-supplied alphabet instead of the fixed digits-and-letters set.
+type DriverString struct {
+	// Length is the number of characters in the challenge. DefaultLen is
+	// used if Length is zero.
+	Length int
+	// Alphabet is the set of characters the challenge is drawn from.
+	// DefaultAlphabet is used if Alphabet is empty.
+	Alphabet string
+}
+
+func (d DriverString) Generate() (content []byte, answer string) {
+	length := d.Length
+	if length == 0 {
+		length = DefaultLen
+	}
+	alphabet := d.Alphabet
+	if alphabet == "" {
+		alphabet = DefaultAlphabet
+	}
+	// randomBytesMod is byte-valued, so it can't index an alphabet longer
+	// than 256 characters; secureIntn has no such limit.
+	pool := []rune(alphabet)
+	buf := make([]rune, length)
+	for i := range buf {
+		buf[i] = pool[secureIntn(len(pool))]
+	}
+	return []byte(string(buf)), string(buf)
+}
+
+func (d DriverString) WriteTo(w io.Writer, content []byte, width, height int) error {
+	_, err := NewTextImage(content, width, height).WriteTo(w)
+	return err
+}
+
+func (d DriverString) Ext() string { return ".png" }
+
+// DriverMath renders a short arithmetic question such as "3 + 7 = ?" and
+// stores the numeric result as the answer.
+type DriverMath struct {
+	// MaxOperand bounds the random operands (inclusive). 20 is used if
+	// MaxOperand is zero.
+	MaxOperand int
+}
+
+func (d DriverMath) Generate() (content []byte, answer string) {
+	max := d.MaxOperand
+	if max == 0 {
+		max = 20
+	}
+	a := secureIntn(max + 1)
+	b := secureIntn(max + 1)
+	ops := []byte{'+', '-', '*'}
+	op := ops[secureIntn(len(ops))]
+
+	var result int
+	switch op {
+	case '+':
+		result = a + b
+	case '-':
+		// Force a non-negative result so the answer doesn't need a sign.
+		if a < b {
+			a, b = b, a
+		}
+		result = a - b
+	case '*':
+		result = a * b
+	}
+
+	question := fmt.Sprintf("%d %c %d = ?", a, op, b)
+	return []byte(question), strconv.Itoa(result)
+}
+
+func (d DriverMath) WriteTo(w io.Writer, content []byte, width, height int) error {
+	_, err := NewTextImage(content, width, height).WriteTo(w)
+	return err
+}
+
+func (d DriverMath) Ext() string { return ".png" }
+
+// chineseChars is the pool DriverChinese draws its challenges from: common
+// simplified Han characters that are easy to tell apart at small sizes.
+const chineseChars = "的一是在不了有和人这中大为上个国我以要他时来用们生到作地于出就分对成会可主发年动同工也能下过子说产种面而方后多定行学法所民得经十三之进着等部度家电力里如水化高自二理起小物现实加量都两体制机当使点从业本去把性好应开它合还因由其些然前外天政四日那社义事平形相全表间样与关各重新线内数正心反你明看原又么利比或但质气第向道命此变条只没结解问意建月公无系军很情者最立代想已通并提直题党程展五果料象员革位入常文总次品式活设及管特件长求老头基资边流路级少图山统接知较将组见计别她手角期根论运农指几九区强放决西被干做必战先回则任取据处队南给色光门即保治北造百规热领七海口东导器压志世金增争济阶油思术极交受联什认六共权收证改清己美再采转更单风切打白教速花带安场身车例真务具万每目至达走积示议声报斗完类八离华名确才科张信马节话米整空元况今集温传土许步群广石记需段研界拉程"
+
+// DriverChinese creates a challenge whose answer is a short sequence of Han
+// characters, rendered as a distorted PNG. The built-in glyph set has no
+// Han glyphs, so every Han character is drawn as the same solid block
+// (see glyphFallback); the image does not show which characters the
+// answer holds.
+type DriverChinese struct {
+	// Length is the number of characters in the challenge. DefaultLen is
+	// used if Length is zero.
+	Length int
+	// Chars is the pool of Han characters the challenge is drawn from.
+	// chineseChars is used if Chars is empty.
+	Chars []rune
+}
+
+func (d DriverChinese) Generate() (content []byte, answer string) {
+	length := d.Length
+	if length == 0 {
+		length = DefaultLen
+	}
+	pool := d.Chars
+	if len(pool) == 0 {
+		pool = []rune(chineseChars)
+	}
+	// chineseChars has well over 256 runes, past what randomBytesMod's
+	// byte-valued output could index; secureIntn has no such limit.
+	buf := make([]rune, length)
+	for i := range buf {
+		buf[i] = pool[secureIntn(len(pool))]
+	}
+	return []byte(string(buf)), string(buf)
+}
+
+func (d DriverChinese) WriteTo(w io.Writer, content []byte, width, height int) error {
+	_, err := NewTextImage(content, width, height).WriteTo(w)
+	return err
+}
+
+func (d DriverChinese) Ext() string { return ".png" }
+
+// DriverAudio renders a run of random decimal digits (0-9 only, unlike
+// DriverDigit's digits and letters) as a WAVE file instead of a PNG, for
+// users who can't read the image representation.
+type DriverAudio struct {
+	// Length is the number of characters in the challenge. DefaultLen is
+	// used if Length is zero.
+	Length int
+	// Lang is the language code stored with the challenge and passed to
+	// NewAudio. "en" is used if Lang is empty. The digits are played as
+	// tones, not speech, so Lang does not change the rendered sound.
+	Lang string
+}
+
+// Generate encodes Lang into content, as [len(lang), lang, digits],
+// instead of leaving it to be read off d by WriteTo. WriteTo is later
+// called on a zero-value DriverAudio looked up from the driver registry by
+// tag (see untagContent), not on this particular d, so Lang has to travel
+// inside content to survive the round trip through storage.
+func (d DriverAudio) Generate() (content []byte, answer string) {
+	length := d.Length
+	if length == 0 {
+		length = DefaultLen
+	}
+	lang := d.Lang
+	if lang == "" {
+		lang = "en"
+	}
+	digits := randomBytesMod(length, 10)
+
+	content = make([]byte, 0, 1+len(lang)+len(digits))
+	content = append(content, byte(len(lang)))
+	content = append(content, lang...)
+	content = append(content, digits...)
+	return content, digitsToString(digits)
+}
+
+func (d DriverAudio) WriteTo(w io.Writer, content []byte, width, height int) error {
+	if len(content) < 1 {
+		return ErrNotFound
+	}
+	langLen := int(content[0])
+	if len(content) < 1+langLen {
+		return ErrNotFound
+	}
+	lang := string(content[1 : 1+langLen])
+	digits := content[1+langLen:]
+	_, err := NewAudio("", digits, lang).WriteTo(w)
+	return err
+}
+
+func (d DriverAudio) Ext() string { return ".wav" }
+
+func digitsToString(digits []byte) string {
+	buf := make([]byte, len(digits))
+	for i, d := range digits {
+		switch {
+		case d < 10:
+			buf[i] = '0' + d
+		default:
+			buf[i] = 'A' + d - 10
+		}
+	}
+	return string(buf)
+}
+
+// driverRegistry holds one instance of every Driver kind NewWithDriver has
+// been asked to use, in registration order. The index a Driver is
+// registered at is persisted alongside its content (see taggedContent) so
+// that Server can find the Driver that must replay a given id without
+// being told which one produced it. Lookups are keyed by type, so every
+// DriverAudio (say) shares one registry entry regardless of which Lang a
+// particular call used — which is exactly why WriteTo must not read
+// configuration fields like Lang off d; they belong in content instead
+// (see DriverAudio.Generate).
+var (
+	driverRegistryMu sync.Mutex
+	driverRegistry   = []Driver{
+		DriverDigit{},
+		DriverString{},
+		DriverMath{},
+		DriverChinese{},
+		DriverAudio{},
+	}
+)
+
+// RegisterDriver adds a custom Driver to the registry Server consults when
+// replaying a stored challenge, and returns the tag NewWithDriver must pass
+// to taggedContent. Built-in drivers are registered automatically; call
+// RegisterDriver only when adding a new challenge type.
+func RegisterDriver(d Driver) byte {
+	driverRegistryMu.Lock()
+	defer driverRegistryMu.Unlock()
+	driverRegistry = append(driverRegistry, d)
+	return byte(len(driverRegistry) - 1)
+}
+
+func driverTag(d Driver) (byte, bool) {
+	driverRegistryMu.Lock()
+	defer driverRegistryMu.Unlock()
+	for i, r := range driverRegistry {
+		if fmt.Sprintf("%T", r) == fmt.Sprintf("%T", d) {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+func driverAt(tag byte) (Driver, bool) {
+	driverRegistryMu.Lock()
+	defer driverRegistryMu.Unlock()
+	if int(tag) >= len(driverRegistry) {
+		return nil, false
+	}
+	return driverRegistry[tag], true
+}
+
+// taggedSentinel marks content produced by NewWithDriver. It can never
+// collide with the plain digit-index slices New and NewLen store (those
+// indices are always below 36), so Server and Verify can tell the two
+// formats apart.
+const taggedSentinel = 0xff
+
+// taggedContent packs tag, answer, and content into the single []byte a
+// Store holds, as [sentinel, tag, len(answer) as uint16 big-endian,
+// answer, content]. The answer travels alongside content (rather than
+// being recomputed from it) because not every Driver's answer is
+// recoverable from content alone — DriverChinese's content is exactly its
+// answer, but DriverMath's content is the rendered question, not the
+// numeric result.
+func taggedContent(tag byte, answer string, content []byte) []byte {
+	out := make([]byte, 0, 4+len(answer)+len(content))
+	out = append(out, taggedSentinel, tag, byte(len(answer)>>8), byte(len(answer)))
+	out = append(out, answer...)
+	return append(out, content...)
+}
+
+func untagContent(stored []byte) (driver Driver, answer string, content []byte, ok bool) {
+	if len(stored) < 4 || stored[0] != taggedSentinel {
+		return nil, "", nil, false
+	}
+	driver, ok = driverAt(stored[1])
+	if !ok {
+		return nil, "", nil, false
+	}
+	answerLen := int(stored[2])<<8 | int(stored[3])
+	if len(stored) < 4+answerLen {
+		return nil, "", nil, false
+	}
+	answer = string(stored[4 : 4+answerLen])
+	content = stored[4+answerLen:]
+	return driver, answer, content, true
+}
+
+// NewWithDriver creates a new captcha using d, saves its content in the
+// internal storage and returns its id together with the answer the user
+// must submit. Unlike New and NewLen, which return only an id and let
+// Server assume a digits-and-letters image, NewWithDriver lets callers
+// pick the challenge type per request; Server dispatches to the matching
+// Driver automatically based on the stored content.
+func NewWithDriver(d Driver) (id, answer string) {
+	tag, ok := driverTag(d)
+	if !ok {
+		tag = RegisterDriver(d)
+	}
+	content, answer := d.Generate()
+	stored := taggedContent(tag, answer, content)
+
+	// Stores such as the one returned by NewStatelessStore derive the id
+	// from the content itself, rather than letting it be chosen upfront.
+	if s, ok := globalStore.(IdentifyingStore); ok {
+		return s.SetReturningID(stored), answer
+	}
+
+	id = randomId()
+	globalStore.Set(id, stored)
+	return id, answer
+}
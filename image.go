@@ -0,0 +1,224 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+const (
+	// StdWidth and StdHeight are the image dimensions capexample and
+	// capgen use when the caller doesn't request a custom size.
+	StdWidth  = 240
+	StdHeight = 80
+)
+
+// glyphWidth and glyphHeight are the dimensions of every entry in
+// glyphFont, in pixels, before scaling to fit an Image's height.
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// glyphFont holds a 5x7 bitmap glyph for every character NewImage and
+// NewTextImage know how to draw: digits 0-9, then uppercase A-Z, in the
+// same order digitsToString uses for digit indices 0-35, followed by the
+// space and the symbols DriverMath's questions use. Each row is read left
+// to right, '1' meaning an inked pixel.
+var glyphFont = map[byte][glyphHeight]string{
+	'0': {"01110", "10001", "10011", "10101", "11001", "10001", "01110"},
+	'1': {"00100", "01100", "00100", "00100", "00100", "00100", "01110"},
+	'2': {"01110", "10001", "00001", "00010", "00100", "01000", "11111"},
+	'3': {"11111", "00010", "00100", "00010", "00001", "10001", "01110"},
+	'4': {"00010", "00110", "01010", "10010", "11111", "00010", "00010"},
+	'5': {"11111", "10000", "11110", "00001", "00001", "10001", "01110"},
+	'6': {"00110", "01000", "10000", "11110", "10001", "10001", "01110"},
+	'7': {"11111", "00001", "00010", "00100", "01000", "01000", "01000"},
+	'8': {"01110", "10001", "10001", "01110", "10001", "10001", "01110"},
+	'9': {"01110", "10001", "10001", "01111", "00001", "00010", "01100"},
+	'A': {"01110", "10001", "10001", "11111", "10001", "10001", "10001"},
+	'B': {"11110", "10001", "10001", "11110", "10001", "10001", "11110"},
+	'C': {"01111", "10000", "10000", "10000", "10000", "10000", "01111"},
+	'D': {"11110", "10001", "10001", "10001", "10001", "10001", "11110"},
+	'E': {"11111", "10000", "10000", "11110", "10000", "10000", "11111"},
+	'F': {"11111", "10000", "10000", "11110", "10000", "10000", "10000"},
+	'G': {"01111", "10000", "10000", "10111", "10001", "10001", "01111"},
+	'H': {"10001", "10001", "10001", "11111", "10001", "10001", "10001"},
+	'I': {"01110", "00100", "00100", "00100", "00100", "00100", "01110"},
+	'J': {"00111", "00010", "00010", "00010", "00010", "10010", "01100"},
+	'K': {"10001", "10010", "10100", "11000", "10100", "10010", "10001"},
+	'L': {"10000", "10000", "10000", "10000", "10000", "10000", "11111"},
+	'M': {"10001", "11011", "10101", "10101", "10001", "10001", "10001"},
+	'N': {"10001", "11001", "10101", "10101", "10011", "10001", "10001"},
+	'O': {"01110", "10001", "10001", "10001", "10001", "10001", "01110"},
+	'P': {"11110", "10001", "10001", "11110", "10000", "10000", "10000"},
+	'Q': {"01110", "10001", "10001", "10001", "10101", "10010", "01101"},
+	'R': {"11110", "10001", "10001", "11110", "10100", "10010", "10001"},
+	'S': {"01111", "10000", "10000", "01110", "00001", "00001", "11110"},
+	'T': {"11111", "00100", "00100", "00100", "00100", "00100", "00100"},
+	'U': {"10001", "10001", "10001", "10001", "10001", "10001", "01110"},
+	'V': {"10001", "10001", "10001", "10001", "10001", "01010", "00100"},
+	'W': {"10001", "10001", "10001", "10101", "10101", "10101", "01010"},
+	'X': {"10001", "10001", "01010", "00100", "01010", "10001", "10001"},
+	'Y': {"10001", "10001", "01010", "00100", "00100", "00100", "00100"},
+	'Z': {"11111", "00001", "00010", "00100", "01000", "10000", "11111"},
+	' ': {"00000", "00000", "00000", "00000", "00000", "00000", "00000"},
+	'+': {"00000", "00100", "00100", "11111", "00100", "00100", "00000"},
+	'-': {"00000", "00000", "00000", "11111", "00000", "00000", "00000"},
+	'*': {"00000", "10101", "01110", "11111", "01110", "10101", "00000"},
+	'=': {"00000", "11111", "00000", "00000", "11111", "00000", "00000"},
+	'?': {"01110", "10001", "00010", "00100", "00100", "00000", "00100"},
+}
+
+// glyphFallback stands in for any character glyphFont has no bitmap for —
+// Han characters and anything else outside the built-in alphabet — as a
+// solid block, so NewTextImage always produces a valid (if not always
+// legible) image instead of skipping the character.
+var glyphFallback = [glyphHeight]string{"11111", "11111", "11111", "11111", "11111", "11111", "11111"}
+
+// glyphFor returns the bitmap glyph for r, mapping lowercase letters onto
+// their uppercase glyph, and falling back to glyphFallback for anything
+// not in glyphFont.
+func glyphFor(r rune) [glyphHeight]string {
+	if 'a' <= r && r <= 'z' {
+		r -= 'a' - 'A'
+	}
+	if r > 0xff {
+		return glyphFallback
+	}
+	if g, ok := glyphFont[byte(r)]; ok {
+		return g
+	}
+	return glyphFallback
+}
+
+// Image is a rendered captcha picture, ready to be PNG-encoded.
+// NewImage and NewTextImage are its only constructors.
+type Image struct {
+	img *image.RGBA
+}
+
+// NewImage renders digits (0-35 indices, as produced by DriverDigit,
+// New, and NewLen) as a distorted PNG image of the given dimensions. id
+// is accepted for backward compatibility with the original WriteImage
+// signature, but the rendering depends only on digits, width, and height.
+func NewImage(id string, digits []byte, width, height int) *Image {
+	chars := make([]byte, len(digits))
+	for i, d := range digits {
+		chars[i] = digitsToString([]byte{d})[0]
+	}
+	return newImageFromChars(chars, width, height)
+}
+
+// NewTextImage renders content as literal text (rather than as 0-35
+// digit indices) into a distorted PNG image of the given dimensions. It
+// backs DriverString, DriverMath, and DriverChinese, whose content is
+// already the text to display.
+func NewTextImage(content []byte, width, height int) *Image {
+	return newImageFromChars([]byte(string(content)), width, height)
+}
+
+func newImageFromChars(chars []byte, width, height int) *Image {
+	if width <= 0 {
+		width = StdWidth
+	}
+	if height <= 0 {
+		height = StdHeight
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	bg := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, bg)
+		}
+	}
+
+	drawNoise(img, width, height)
+
+	runes := []rune(string(chars))
+	if len(runes) == 0 {
+		return &Image{img: img}
+	}
+
+	cellWidth := width / len(runes)
+	scale := cellWidth / (glyphWidth + 2)
+	if scale < 1 {
+		scale = 1
+	}
+	inkWidth := glyphWidth * scale
+	inkHeight := glyphHeight * scale
+	top := (height - inkHeight) / 2
+	if top < 0 {
+		top = 0
+	}
+
+	ink := color.RGBA{R: 0, G: 0, B: 0, A: 255}
+	for i, r := range runes {
+		glyph := glyphFor(r)
+		left := i*cellWidth + (cellWidth-inkWidth)/2
+		drawGlyph(img, glyph, left, top, scale, ink)
+	}
+
+	return &Image{img: img}
+}
+
+// drawGlyph paints glyph at (left, top), each of its cells scaled to a
+// scale x scale block.
+func drawGlyph(img *image.RGBA, glyph [glyphHeight]string, left, top, scale int, ink color.RGBA) {
+	bounds := img.Bounds()
+	for row := 0; row < glyphHeight; row++ {
+		line := glyph[row]
+		for col := 0; col < glyphWidth && col < len(line); col++ {
+			if line[col] != '1' {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					x := left + col*scale + dx
+					y := top + row*scale + dy
+					if image.Pt(x, y).In(bounds) {
+						img.Set(x, y, ink)
+					}
+				}
+			}
+		}
+	}
+}
+
+// drawNoise scatters a handful of random lines across img, a cheap way to
+// make the rendered captcha harder for simple thresholding OCR to clean up.
+func drawNoise(img *image.RGBA, width, height int) {
+	noise := color.RGBA{R: 180, G: 180, B: 180, A: 255}
+	lines := 1 + int(randomBytesMod(1, 4)[0])
+	for i := 0; i < lines; i++ {
+		// height can exceed what randomBytesMod's byte-valued modulus can
+		// express (and a multiple of 256 would wrap it to 0, a
+		// divide-by-zero); secureIntn takes an int modulus instead.
+		y := secureIntn(height)
+		for x := 0; x < width; x++ {
+			offset := int(randomBytesMod(1, 5)[0]) - 2
+			py := y + offset
+			if py >= 0 && py < height {
+				img.Set(x, py, noise)
+			}
+		}
+	}
+}
+
+// WriteTo PNG-encodes the image and writes it to w, satisfying
+// io.WriterTo.
+func (m *Image) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m.img); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
@@ -0,0 +1,60 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"math/big"
+)
+
+// randomBytes returns length cryptographically random bytes.
+func randomBytes(length int) []byte {
+	b := make([]byte, length)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic("captcha: error reading random source: " + err.Error())
+	}
+	return b
+}
+
+// randomBytesMod returns length random bytes, each in [0, mod). It and
+// secureIntn, both backed by crypto/rand, are the sources of randomness
+// every challenge-generating Driver uses, so that the value an attacker
+// has to guess never depends on the weaker math/rand package.
+func randomBytesMod(length int, mod byte) []byte {
+	b := randomBytes(length)
+	for i, v := range b {
+		b[i] = v % mod
+	}
+	return b
+}
+
+// randomId returns a random, URL-safe id for a captcha, suitable for
+// embedding in a file name (see Server).
+func randomId() string {
+	return hex.EncodeToString(randomBytes(32))
+}
+
+// RandomDigits returns a slice of length random digits in [0, 9], the same
+// alphabet DriverAudio and capgen use. Unlike the 0-35 digit-and-letter
+// indices New and NewLen store, these are plain decimal digits, since
+// that's the only alphabet the audio representation and command-line tool
+// ever speak.
+func RandomDigits(length int) []byte {
+	return randomBytesMod(length, 10)
+}
+
+// secureIntn returns a cryptographically random number in [0, n), the
+// crypto/rand equivalent of math/rand's Intn, for callers that need a
+// single value rather than a slice (DriverMath's operands and operator
+// choice don't fit the []byte shape randomBytesMod returns).
+func secureIntn(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic("captcha: error reading random source: " + err.Error())
+	}
+	return int(v.Int64())
+}
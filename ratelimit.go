@@ -0,0 +1,159 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RateLimitOptions configures RateLimitedServer and RateLimitedVerify.
+type RateLimitOptions struct {
+	// KeyFunc identifies the caller a limit is tracked against. The
+	// default keys on the requesting IP address (r.RemoteAddr with the
+	// port stripped); deployments behind a proxy should supply a KeyFunc
+	// that reads a forwarded-for header or session cookie instead.
+	KeyFunc func(r *http.Request) string
+
+	// IssueLimit is how many times a single key may hit "?reload=" on the
+	// handler returned by Server within IssueWindow. Zero means no limit.
+	IssueLimit int
+	// IssueWindow is the duration an IssueLimit applies over. Defaults to
+	// one minute if zero.
+	IssueWindow time.Duration
+
+	// AttemptLimit is how many wrong answers a single captcha id
+	// tolerates before RateLimitedVerify force-invalidates it, so that
+	// the id can't be brute-forced by guessing. Zero means no limit.
+	AttemptLimit int
+	// AttemptWindow is the duration an AttemptLimit applies over.
+	// Defaults to one minute if zero.
+	AttemptWindow time.Duration
+
+	// Store backs the request counters RateLimitedServer and
+	// RateLimitedVerify keep, so limits are shared across replicas the
+	// same way NewRedisStore shares captcha content across them. Defaults
+	// to a package-wide in-process memory store, which only limits
+	// callers of this one instance. Callers that set RateLimitOptions.Store
+	// explicitly should reuse the same Store value across calls, the same
+	// way globalStore is shared, rather than constructing a new one per
+	// call: a fresh Store never has a previous count to build on.
+	Store Store
+}
+
+// defaultRateLimitStore backs RateLimitOptions whose Store is left unset.
+// It must be shared across calls (unlike a Store built fresh each time)
+// so that counters for the same key actually accumulate between requests.
+var defaultRateLimitStore = NewMemoryStore(CollectNum, Expiration)
+
+func (o *RateLimitOptions) withDefaults() RateLimitOptions {
+	opts := *o
+	if opts.KeyFunc == nil {
+		opts.KeyFunc = remoteAddrKey
+	}
+	if opts.IssueWindow == 0 {
+		opts.IssueWindow = time.Minute
+	}
+	if opts.AttemptWindow == 0 {
+		opts.AttemptWindow = time.Minute
+	}
+	if opts.Store == nil {
+		opts.Store = defaultRateLimitStore
+	}
+	return opts
+}
+
+func remoteAddrKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitedServer wraps next (typically the handler returned by Server)
+// so that a single key, as identified by opts.KeyFunc, can't request an
+// unbounded stream of captchas by hitting "?reload=" repeatedly, which is
+// both a denial-of-service vector and free OCR training data. Requests
+// over opts.IssueLimit receive a 429 Too Many Requests instead of being
+// forwarded to next.
+func RateLimitedServer(next http.Handler, opts RateLimitOptions) http.Handler {
+	o := opts.withDefaults()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.IssueLimit > 0 && r.FormValue("reload") != "" {
+			key := "ratelimit:issue:" + o.KeyFunc(r)
+			if incrCounter(o.Store, key, o.IssueWindow) > o.IssueLimit {
+				http.Error(w, "too many captcha requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimitedVerify is Verify's rate-limited counterpart: it counts wrong
+// answers for id and, once opts.AttemptLimit is exceeded, force-invalidates
+// the captcha (as if it had been verified successfully) so that it can no
+// longer be brute-forced by guessing, even with WithKeepOnFailure(true) set
+// in verifyOpts.
+func RateLimitedVerify(id string, digits []byte, opts RateLimitOptions, verifyOpts ...VerifyOption) bool {
+	return rateLimitedVerify(id, opts, func() bool {
+		return Verify(id, digits, verifyOpts...)
+	})
+}
+
+// RateLimitedVerifyString is RateLimitedVerify for a string answer, the
+// same way VerifyString is Verify for a string answer.
+func RateLimitedVerifyString(id string, answer string, opts RateLimitOptions, verifyOpts ...VerifyOption) bool {
+	return rateLimitedVerify(id, opts, func() bool {
+		return VerifyString(id, answer, verifyOpts...)
+	})
+}
+
+func rateLimitedVerify(id string, opts RateLimitOptions, verify func() bool) bool {
+	o := opts.withDefaults()
+	if verify() {
+		return true
+	}
+	if o.AttemptLimit > 0 {
+		key := "ratelimit:attempt:" + id
+		if incrCounter(o.Store, key, o.AttemptWindow) > o.AttemptLimit {
+			globalStore.Get(id, true) // force-invalidate: drop the captcha for good
+		}
+	}
+	return false
+}
+
+// incrCounter increments the count kept under key in store and returns the
+// new value, resetting it to 1 if window has elapsed since the count was
+// last reset. It is best-effort, not atomic: concurrent callers can race
+// on the read-modify-write the same way Reload already races against
+// Verify on the same id. That's an acceptable tradeoff for a rate limiter,
+// where occasionally letting one extra request through is harmless; a
+// deployment that needs a hard guarantee should put a dedicated limiter
+// (or an atomic-incr-capable Store) in front instead.
+func incrCounter(store Store, key string, window time.Duration) int {
+	now := time.Now()
+	count := 0
+	resetAt := now.Add(window).Unix()
+
+	if raw := store.Get(key, false); len(raw) == 16 {
+		prevCount := binary.BigEndian.Uint64(raw[:8])
+		prevResetAt := int64(binary.BigEndian.Uint64(raw[8:]))
+		if now.Unix() <= prevResetAt {
+			count = int(prevCount)
+			resetAt = prevResetAt
+		}
+	}
+	count++
+
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], uint64(count))
+	binary.BigEndian.PutUint64(buf[8:], uint64(resetAt))
+	store.Set(key, buf)
+	return count
+}
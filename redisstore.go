@@ -0,0 +1,65 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStore is a Store that keeps captcha content in Redis, so that a
+// captcha issued by one process can be verified by another. Unlike
+// memoryStore, it runs no background collection goroutine: expiration is
+// handled by Redis itself via the TTL passed to NewRedisStore.
+type redisStore struct {
+	client    redis.UniversalClient
+	keyPrefix string
+	ttl       time.Duration
+}
+
+// NewRedisStore returns a Store backed by client, for deployments that run
+// more than one instance behind a load balancer. Each captcha's content is
+// stored under keyPrefix+id with the given ttl; Get with clear set to true
+// uses Redis's GETDEL so that fetching the answer to verify it is atomic
+// with invalidating it, closing the race a separate GET followed by DEL
+// would have under concurrent requests for the same id.
+//
+// Register it with SetCustomStore before generating any captchas, e.g.:
+//
+//	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+//	captcha.SetCustomStore(captcha.NewRedisStore(client, "captcha:", 10*time.Minute))
+func NewRedisStore(client redis.UniversalClient, keyPrefix string, ttl time.Duration) Store {
+	return &redisStore{client: client, keyPrefix: keyPrefix, ttl: ttl}
+}
+
+func (s *redisStore) key(id string) string {
+	return s.keyPrefix + id
+}
+
+func (s *redisStore) Set(id string, digits []byte) {
+	// Errors are not actionable here: Store has no error return, matching
+	// memoryStore's signature, so a failed Set simply means Get(id, ...)
+	// will later report the captcha as not found.
+	s.client.Set(context.Background(), s.key(id), digits, s.ttl)
+}
+
+func (s *redisStore) Get(id string, clear bool) (digits []byte) {
+	ctx := context.Background()
+	var (
+		val string
+		err error
+	)
+	if clear {
+		val, err = s.client.GetDel(ctx, s.key(id)).Result()
+	} else {
+		val, err = s.client.Get(ctx, s.key(id)).Result()
+	}
+	if err != nil {
+		return nil
+	}
+	return []byte(val)
+}
@@ -0,0 +1,68 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisStore(t *testing.T, ttl time.Duration) (Store, *miniredis.Miniredis) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis.Run: %v", err)
+	}
+	t.Cleanup(mr.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedisStore(client, "captcha:", ttl), mr
+}
+
+func TestRedisStoreGetDelIsAtomic(t *testing.T) {
+	store, _ := newTestRedisStore(t, time.Minute)
+	digits := []byte{1, 2, 3, 4, 5, 6}
+	store.Set("id1", digits)
+
+	// A peek (clear=false) must not consume the captcha.
+	if got := store.Get("id1", false); string(got) != string(digits) {
+		t.Fatalf("Get(false) = %v, want %v", got, digits)
+	}
+
+	// Get with clear=true is the GETDEL path: it must return the value
+	// and, in the same round trip, remove it so a concurrent verifier
+	// can never see it twice.
+	if got := store.Get("id1", true); string(got) != string(digits) {
+		t.Fatalf("Get(true) = %v, want %v", got, digits)
+	}
+	if got := store.Get("id1", false); got != nil {
+		t.Fatalf("Get after GETDEL = %v, want nil", got)
+	}
+}
+
+func TestRedisStoreExpires(t *testing.T) {
+	ttl := 50 * time.Millisecond
+	store, mr := newTestRedisStore(t, ttl)
+	store.Set("id1", []byte{1, 2, 3})
+
+	// miniredis doesn't expire keys on wall-clock time; its simulated
+	// clock only advances (and TTLs with it) when told to.
+	mr.FastForward(ttl)
+	if got := store.Get("id1", false); got != nil {
+		t.Fatalf("Get after ttl = %v, want nil", got)
+	}
+}
+
+func TestRedisStoreMissingID(t *testing.T) {
+	store, _ := newTestRedisStore(t, time.Minute)
+	if got := store.Get("does-not-exist", true); got != nil {
+		t.Fatalf("Get(missing) = %v, want nil", got)
+	}
+}
@@ -12,13 +12,20 @@ type captchaHandler struct {
 	imgHeight int
 }
 
-// Server returns a handler that serves HTTP requests with image representations of captchas.
-// Image dimensions are accepted as arguments. The server decides which captcha to serve
-// based on the last URL path component: file name part must contain a captcha id,
-// file extension must be ".png".
+// Server returns a handler that serves HTTP requests with image and audio
+// representations of captchas. Image dimensions are accepted as arguments.
+// The server decides which captcha to serve based on the last URL path
+// component: file name part must contain a captcha id, file extension must
+// be ".png" for an image or ".wav" for an audio file.
 //
-// For example, for file name "LBm5vMjHDtdUfaWYXiQX.png" it serves an image captcha
-// with id "LBm5vMjHDtdUfaWYXiQX".
+// For example, for file name "LBm5vMjHDtdUfaWYXiQX.png" it serves an image
+// captcha with id "LBm5vMjHDtdUfaWYXiQX".
+//
+// Captchas created with NewWithDriver are served through whichever Driver
+// created them, so a DriverMath challenge is still rendered as its question
+// and a DriverAudio challenge is only ever servable as ".wav".
+// Requesting the wrong extension for a given id is a 404, the same as
+// requesting an id that doesn't exist.
 //
 // To serve a captcha as a downloadable file, the URL must be constructed in
 // such a way as if the file to serve is in the "download" subdirectory:
@@ -37,15 +44,11 @@ func (h *captchaHandler) serve(w http.ResponseWriter, r *http.Request, id, ext s
 	w.Header().Set("Expires", "0")
 
 	var content bytes.Buffer
-	if ext != ".png" {
-		return ErrNotFound
-	}
-
-	w.Header().Set("Content-Type", "image/png")
-	if err := WriteImage(&content, id, h.imgWidth, h.imgHeight); err != nil {
+	if err := renderCaptcha(&content, id, ext, h.imgWidth, h.imgHeight); err != nil {
 		return err
 	}
 
+	w.Header().Set("Content-Type", extContentType(ext))
 	if download {
 		w.Header().Set("Content-Type", "application/octet-stream")
 	}
@@ -53,6 +56,17 @@ func (h *captchaHandler) serve(w http.ResponseWriter, r *http.Request, id, ext s
 	return nil
 }
 
+func extContentType(ext string) string {
+	switch ext {
+	case ".wav":
+		return "audio/wav"
+	case ".mp3":
+		return "audio/mpeg"
+	default:
+		return "image/png"
+	}
+}
+
 func (h *captchaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	dir, file := path.Split(r.URL.Path)
 	ext := path.Ext(file)
@@ -0,0 +1,121 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+)
+
+// IdentifyingStore is implemented by stores whose id is derived from the
+// content itself rather than chosen ahead of time by New, NewLen, or
+// NewWithDriver. The stateless store returned by NewStatelessStore is the
+// only built-in implementation: its id is a signed, self-describing token,
+// so there is nothing to look up by a separately chosen id.
+type IdentifyingStore interface {
+	Store
+
+	// SetReturningID saves content and returns the id it must be looked
+	// up under, which the caller could not have known in advance.
+	SetReturningID(content []byte) (id string)
+}
+
+// statelessStore is a Store that keeps no server-side state at all. The id
+// returned by SetReturningID is the captcha itself: a token carrying the
+// content, an expiry, and an authentication tag, encrypted and signed with
+// an AEAD cipher keyed from secret. Get only has to verify and decrypt the
+// token; there is no shared storage to fail over or scale, which makes it
+// a good fit for serverless or edge deployments that can't rely on sticky
+// sessions or a database like Redis.
+//
+// The tradeoff is that a token cannot be invalidated once issued: Get
+// ignores clear, so Verify and VerifyString report the same (token,
+// answer) pair as solved every time it is submitted until ttl expires,
+// since there is no server-side record to mark as consumed. Reload is also unsupported
+// for the same reason: a token's content can't be changed without
+// generating a new token under a new id. Deployments that need either
+// property should use NewMemoryStore or NewRedisStore instead.
+type statelessStore struct {
+	aead cipher.AEAD
+	ttl  time.Duration
+}
+
+// NewStatelessStore returns a Store that signs and encrypts captcha
+// content into the id itself using secret, instead of keeping it in
+// server-side storage. Register it with SetCustomStore before generating
+// any captchas:
+//
+//	captcha.SetCustomStore(captcha.NewStatelessStore(secret, 10*time.Minute))
+func NewStatelessStore(secret []byte, ttl time.Duration) Store {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		// key is always 32 bytes (sha256.Sum256's output), so this can't
+		// happen with the standard library's AES implementation.
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &statelessStore{aead: aead, ttl: ttl}
+}
+
+func (s *statelessStore) SetReturningID(content []byte) (id string) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return ""
+	}
+
+	var expiry [8]byte
+	binary.BigEndian.PutUint64(expiry[:], uint64(time.Now().Add(s.ttl).Unix()))
+
+	// The nonce and expiry are authenticated alongside the content so
+	// neither can be swapped onto a different token's ciphertext.
+	sealed := s.aead.Seal(nil, nonce, content, append(nonce, expiry[:]...))
+
+	token := make([]byte, 0, len(nonce)+len(expiry)+len(sealed))
+	token = append(token, nonce...)
+	token = append(token, expiry[:]...)
+	token = append(token, sealed...)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// Set exists to satisfy Store, but is a no-op: a stateless token's content
+// is fixed at creation, so there is nothing to save it under the
+// already-issued id. Reload recognizes this store as an IdentifyingStore
+// and returns false without calling Set.
+func (s *statelessStore) Set(id string, content []byte) {}
+
+func (s *statelessStore) Get(id string, clear bool) (content []byte) {
+	token, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(token) < nonceSize+8 {
+		return nil
+	}
+	nonce := token[:nonceSize]
+	expiry := token[nonceSize : nonceSize+8]
+	sealed := token[nonceSize+8:]
+
+	expiresAt := int64(binary.BigEndian.Uint64(expiry))
+	if time.Now().Unix() > expiresAt {
+		return nil
+	}
+
+	content, err = s.aead.Open(nil, nonce, sealed, append(append([]byte{}, nonce...), expiry...))
+	if err != nil {
+		return nil
+	}
+	return content
+}
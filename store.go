@@ -0,0 +1,109 @@
+// Copyright 2011 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package captcha
+
+import (
+	"sync"
+	"time"
+)
+
+// Store is an interface for a captcha storage backend: something that can
+// remember the content a captcha id was issued with, and hand it back (or
+// clear it) on demand. New, NewLen, NewWithDriver, Verify, VerifyString,
+// and Reload all go through globalStore, the Store SetCustomStore last
+// configured, rather than talking to a specific implementation directly.
+type Store interface {
+	// Set saves content under id, replacing any content already stored
+	// under that id.
+	Set(id string, content []byte)
+
+	// Get returns the content stored under id, or nil if there is none.
+	// If clear is true, the content is also removed from the store, so
+	// that it cannot be retrieved (or verified) a second time.
+	Get(id string, clear bool) (content []byte)
+}
+
+// expiringValue pairs stored content with the time it was saved, so
+// memoryStore's collector can tell how long it has been sitting around.
+type expiringValue struct {
+	timestamp time.Time
+	content   []byte
+}
+
+// memoryStore is the default, in-process Store used by globalStore and
+// defaultRateLimitStore. It keeps everything in a map protected by a
+// mutex, and runs a collection pass every collectNum calls to Set to
+// evict anything older than expiration — so captchas a user never solved
+// don't accumulate forever.
+type memoryStore struct {
+	mu         sync.Mutex
+	values     map[string]expiringValue
+	numStored  int
+	collectNum int
+	expiration time.Duration
+}
+
+// NewMemoryStore returns a new in-process Store. Captchas that have not
+// been retrieved with clear set to true are collected (and their memory
+// freed) once collectNum more captchas have been stored since the last
+// collection, provided they are older than expiration; collectNum set too
+// low makes collection run (and lock out other Store calls) more often,
+// while set too high lets more stale captchas pile up in memory between
+// collections.
+func NewMemoryStore(collectNum int, expiration time.Duration) Store {
+	return &memoryStore{
+		values:     make(map[string]expiringValue),
+		collectNum: collectNum,
+		expiration: expiration,
+	}
+}
+
+func (s *memoryStore) Set(id string, content []byte) {
+	s.mu.Lock()
+	s.values[id] = expiringValue{timestamp: time.Now(), content: content}
+	s.numStored++
+	numStored := s.numStored
+	s.mu.Unlock()
+
+	if numStored >= s.collectNum {
+		go s.collect()
+	}
+}
+
+func (s *memoryStore) Get(id string, clear bool) (content []byte) {
+	if !clear {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v, ok := s.values[id]
+		if !ok {
+			return nil
+		}
+		return v.content
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[id]
+	if !ok {
+		return nil
+	}
+	delete(s.values, id)
+	return v.content
+}
+
+// collect evicts every value older than s.expiration and resets the
+// counter Set uses to decide when to run the next pass.
+func (s *memoryStore) collect() {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, v := range s.values {
+		if now.Sub(v.timestamp) > s.expiration {
+			delete(s.values, id)
+		}
+	}
+	s.numStored = 0
+}